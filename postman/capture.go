@@ -0,0 +1,36 @@
+package postman
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/loadimpact/speedboat/postman/capture"
+)
+
+// CaptureConfig is Runner's hook into the object-storage capture sink: set
+// it to mirror a sample of request/response pairs (by rate, by failure,
+// or by response status) to an S3-compatible bucket for later inspection.
+type CaptureConfig = capture.Config
+
+// maybeCapture records req/res into u.capture if the sink exists and
+// Config.ShouldCapture says this particular request is one of the
+// sampled/failed/high-status ones worth keeping.
+func (u *VU) maybeCapture(status int, failed bool, method, reqURL string, reqHeaders map[string]string, reqBody []byte, resHeaders map[string]string, resBody []byte) {
+	if u.capture == nil || !u.Runner.Capture.ShouldCapture(status, failed) {
+		return
+	}
+	err := u.capture.Add(capture.Record{
+		VU:              u.id,
+		Timestamp:       time.Now(),
+		Method:          method,
+		URL:             reqURL,
+		RequestHeaders:  reqHeaders,
+		RequestBody:     string(reqBody),
+		Status:          status,
+		ResponseHeaders: resHeaders,
+		ResponseBody:    string(resBody),
+	})
+	if err != nil {
+		log.WithError(err).Warn("Failed to capture request/response")
+	}
+}
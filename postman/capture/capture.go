@@ -0,0 +1,223 @@
+// Package capture implements a sampling sink that mirrors full
+// request/response pairs to an S3-compatible object store, for the
+// collections and requests worth inspecting after the fact rather than
+// just counting pass/fail on.
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFlushBytes is the uncompressed NDJSON size of a batch that
+	// triggers a flush.
+	DefaultFlushBytes = 16 * 1024 * 1024
+	// DefaultFlushInterval is the age that triggers a flush even if
+	// DefaultFlushBytes hasn't been reached.
+	DefaultFlushInterval = 30 * time.Second
+	// DefaultBodyCap bounds how much of a single request/response body a
+	// Record keeps, so one oversized payload can't blow the batch budget.
+	DefaultBodyCap = 1 << 20 // 1 MiB
+)
+
+// Config selects which requests get captured and where the batches go.
+type Config struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+
+	// SampleRate, if > 0, captures that fraction of requests (e.g. 0.01
+	// for 1%). OnlyFailures and MinStatus are ORed with it: a request
+	// that matches either is captured regardless of the sample roll.
+	SampleRate   float64
+	OnlyFailures bool
+	MinStatus    int
+
+	RunID string
+	VUID  int64
+
+	FlushBytes    int
+	FlushInterval time.Duration
+	BodyCap       int
+}
+
+func (c Config) withDefaults() Config {
+	if c.FlushBytes <= 0 {
+		c.FlushBytes = DefaultFlushBytes
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = DefaultFlushInterval
+	}
+	if c.BodyCap <= 0 {
+		c.BodyCap = DefaultBodyCap
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	return c
+}
+
+// Record is one captured request/response pair, serialized as a single
+// NDJSON line.
+type Record struct {
+	VU              int64             `json:"vu"`
+	Timestamp       time.Time         `json:"timestamp"`
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	RequestHeaders  map[string]string `json:"request_headers"`
+	RequestBody     string            `json:"request_body"`
+	Status          int               `json:"status"`
+	ResponseHeaders map[string]string `json:"response_headers"`
+	ResponseBody    string            `json:"response_body"`
+}
+
+// ShouldCapture decides whether a request with the given status (and
+// failed flag, for transport-level errors that never got a status) is
+// one this sink wants a copy of.
+func (c Config) ShouldCapture(status int, failed bool) bool {
+	if c.OnlyFailures && failed {
+		return true
+	}
+	if c.MinStatus > 0 && status >= c.MinStatus {
+		return true
+	}
+	if c.SampleRate > 0 && rand.Float64() < c.SampleRate {
+		return true
+	}
+	return false
+}
+
+// Sink batches Records into gzip-compressed NDJSON objects and uploads
+// them once a batch reaches Config.FlushBytes or Config.FlushInterval.
+type Sink struct {
+	cfg    Config
+	client *http.Client
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	gz         *gzip.Writer
+	count      int
+	queuedSize int
+	seq        int64
+	opened     time.Time
+	flushed    chan struct{}
+}
+
+func New(cfg Config) *Sink {
+	cfg = cfg.withDefaults()
+	s := &Sink{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		opened:  time.Now(),
+		flushed: make(chan struct{}),
+	}
+	s.gz = gzip.NewWriter(&s.buf)
+	go s.ageLoop()
+	return s
+}
+
+func (s *Sink) ageLoop() {
+	t := time.NewTicker(s.cfg.FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			if s.count > 0 && time.Since(s.opened) >= s.cfg.FlushInterval {
+				s.flushLocked()
+			}
+			s.mu.Unlock()
+		case <-s.flushed:
+			return
+		}
+	}
+}
+
+// Add appends rec to the current batch, truncating its bodies to
+// Config.BodyCap, flushing first if that would push the batch over
+// Config.FlushBytes.
+func (s *Sink) Add(rec Record) error {
+	rec.RequestBody = truncate(rec.RequestBody, s.cfg.BodyCap)
+	rec.ResponseBody = truncate(rec.ResponseBody, s.cfg.BodyCap)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queuedSize > 0 && s.queuedSize+len(line) > s.cfg.FlushBytes {
+		if err := s.flushLocked(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.gz.Write(line); err != nil {
+		return err
+	}
+	s.count++
+	s.queuedSize += len(line)
+	return nil
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+// Close flushes any pending batch and stops the age-based flush loop.
+func (s *Sink) Close() error {
+	close(s.flushed)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	return s.flushLocked()
+}
+
+func (s *Sink) flushLocked() error {
+	if err := s.gz.Close(); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s/%d/%d-%d.ndjson.gz", s.cfg.RunID, s.cfg.VUID, time.Now().UnixNano(), s.seq)
+	s.seq++
+	data := s.buf.Bytes()
+
+	if err := s.upload(key, data); err != nil {
+		return err
+	}
+
+	s.buf.Reset()
+	s.gz = gzip.NewWriter(&s.buf)
+	s.count = 0
+	s.queuedSize = 0
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *Sink) objectURL(key string) string {
+	scheme := "http"
+	if s.cfg.UseSSL {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: s.cfg.Endpoint, Path: "/" + s.cfg.Bucket + "/" + key}
+	return u.String()
+}
@@ -0,0 +1,202 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShouldCapture(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    Config
+		status int
+		failed bool
+		want   bool
+	}{
+		{"only-failures hit", Config{OnlyFailures: true}, 200, true, true},
+		{"only-failures miss", Config{OnlyFailures: true}, 200, false, false},
+		{"min-status hit", Config{MinStatus: 500}, 503, false, true},
+		{"min-status miss", Config{MinStatus: 500}, 404, false, false},
+		{"sample-rate always", Config{SampleRate: 1}, 200, false, true},
+		{"sample-rate never", Config{SampleRate: 0}, 200, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.cfg.ShouldCapture(c.status, c.failed); got != c.want {
+				t.Errorf("ShouldCapture(%d, %v) = %v, want %v", c.status, c.failed, got, c.want)
+			}
+		})
+	}
+}
+
+// uploadRecorder is a tiny S3-compatible stand-in: it accepts PUT/POST and
+// records every object body it receives, decompressing ndjson.gz batches.
+type uploadRecorder struct {
+	mu      sync.Mutex
+	batches [][]string // one []string of decoded NDJSON lines per PUT
+	hits    int
+}
+
+func (r *uploadRecorder) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.hits++
+		r.mu.Unlock()
+
+		if req.Method != http.MethodPut {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		raw, err := ioutil.ReadAll(gz)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var lines []string
+		for _, l := range strings.Split(strings.TrimRight(string(raw), "\n"), "\n") {
+			if l != "" {
+				lines = append(lines, l)
+			}
+		}
+
+		r.mu.Lock()
+		r.batches = append(r.batches, lines)
+		r.mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (r *uploadRecorder) hitCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hits
+}
+
+func (r *uploadRecorder) totalLines() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, b := range r.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func testEndpoint(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", srv.URL, err)
+	}
+	return u.Host
+}
+
+func TestSinkFlushesOnSize(t *testing.T) {
+	rec := &uploadRecorder{}
+	srv := httptest.NewServer(rec.handler())
+	defer srv.Close()
+
+	s := New(Config{
+		Endpoint:      testEndpoint(t, srv),
+		Bucket:        "bucket",
+		RunID:         "run1",
+		VUID:          1,
+		FlushBytes:    120, // small enough that a couple of records trips it
+		FlushInterval: time.Hour,
+	})
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Add(Record{Method: "GET", URL: "http://example.com/thing", Status: 200}); err != nil {
+			t.Fatalf("Add(%d): %v", i, err)
+		}
+	}
+
+	if hits := rec.hitCount(); hits == 0 {
+		t.Fatal("expected at least one size-triggered flush, got none")
+	}
+}
+
+func TestSinkFlushesOnAge(t *testing.T) {
+	rec := &uploadRecorder{}
+	srv := httptest.NewServer(rec.handler())
+	defer srv.Close()
+
+	s := New(Config{
+		Endpoint:      testEndpoint(t, srv),
+		Bucket:        "bucket",
+		RunID:         "run1",
+		VUID:          1,
+		FlushBytes:    DefaultFlushBytes, // effectively unreachable by one record
+		FlushInterval: 20 * time.Millisecond,
+	})
+	defer s.Close()
+
+	if err := s.Add(Record{Method: "GET", URL: "http://example.com/thing", Status: 200}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for rec.hitCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.hitCount() == 0 {
+		t.Fatal("expected the age-based flush loop to upload the pending record")
+	}
+}
+
+func TestSinkCloseFlushesPendingBatch(t *testing.T) {
+	rec := &uploadRecorder{}
+	srv := httptest.NewServer(rec.handler())
+	defer srv.Close()
+
+	s := New(Config{
+		Endpoint:      testEndpoint(t, srv),
+		Bucket:        "bucket",
+		RunID:         "run1",
+		VUID:          1,
+		FlushBytes:    DefaultFlushBytes,
+		FlushInterval: time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := s.Add(Record{Method: "GET", URL: "http://example.com/thing", Status: 200}); err != nil {
+			t.Fatalf("Add(%d): %v", i, err)
+		}
+	}
+	if rec.hitCount() != 0 {
+		t.Fatalf("expected no flush before Close, got %d hits", rec.hitCount())
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if rec.hitCount() != 1 {
+		t.Fatalf("hits after Close = %d, want 1", rec.hitCount())
+	}
+	if got := rec.totalLines(); got != 3 {
+		t.Fatalf("captured %d records, want 3", got)
+	}
+}
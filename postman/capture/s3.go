@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/loadimpact/speedboat/postman/awssign"
+)
+
+// multipartThreshold is where upload switches from a single PUT to an S3
+// multipart upload (CreateMultipartUpload/UploadPart/CompleteMultipartUpload),
+// the same three-request dance a browser or the AWS CLI uses for a big
+// object. Parts are sent one after another; a failed part fails the whole
+// upload, and no part is retried.
+const multipartThreshold = 8 * 1024 * 1024
+const partSize = 5 * 1024 * 1024 // S3's minimum part size (besides the last one)
+
+func (s *Sink) upload(key string, data []byte) error {
+	if len(data) <= multipartThreshold {
+		return s.putObject(key, data)
+	}
+	return s.putObjectMultipart(key, data)
+}
+
+func (s *Sink) putObject(key string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	awssign.Sign(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", "", data)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("capture: PUT %s: %s: %s", key, res.Status, body)
+	}
+	return nil
+}
+
+func (s *Sink) putObjectMultipart(key string, data []byte) error {
+	uploadID, err := s.createMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+
+	var parts []completedPart
+	for partNumber, start := 1, 0; start < len(data); partNumber, start = partNumber+1, start+partSize {
+		end := start + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		etag, err := s.uploadPart(key, uploadID, partNumber, data[start:end])
+		if err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+	}
+
+	return s.completeMultipartUpload(key, uploadID, parts)
+}
+
+func (s *Sink) createMultipartUpload(key string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, s.objectURL(key)+"?uploads", nil)
+	if err != nil {
+		return "", err
+	}
+	awssign.Sign(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", "", nil)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode >= 300 {
+		return "", fmt.Errorf("capture: CreateMultipartUpload %s: %s: %s", key, res.Status, body)
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+func (s *Sink) uploadPart(key, uploadID string, partNumber int, data []byte) (string, error) {
+	url := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", s.objectURL(key), partNumber, uploadID)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	awssign.Sign(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", "", data)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("capture: UploadPart %s#%d: %s: %s", key, partNumber, res.Status, body)
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *Sink) completeMultipartUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s?uploadId=%s", s.objectURL(key), uploadID)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	awssign.Sign(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, "s3", "", body)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("capture: CompleteMultipartUpload %s: %s: %s", key, res.Status, respBody)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package postman
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Collection is the root of a Postman v2.1 collection export. Only the
+// subset of the schema that the runner actually consumes is modelled here.
+type Collection struct {
+	Info     Info       `json:"info"`
+	Item     []Item     `json:"item"`
+	Event    []Event    `json:"event"`
+	Auth     Auth       `json:"auth"`
+	Variable []Variable `json:"variable"`
+}
+
+type Info struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+// Item is either a request or a folder (a folder has a non-empty Item
+// slice of its own and no Request).
+type Item struct {
+	Name     string     `json:"name"`
+	Item     []Item     `json:"item"`
+	Event    []Event    `json:"event"`
+	Request  Request    `json:"request"`
+	Auth     Auth       `json:"auth"`
+	Variable []Variable `json:"variable"`
+}
+
+type Request struct {
+	Method string   `json:"method"`
+	URL    string   `json:"url"`
+	Header []Header `json:"header"`
+	Body   Body     `json:"body"`
+	Auth   Auth     `json:"auth"`
+}
+
+// Header is enabled unless explicitly marked disabled (the schema omits
+// "disabled" entirely for an enabled header, so it can't be a plain
+// json-tagged bool).
+type Header struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Enabled bool   `json:"-"`
+}
+
+func (h *Header) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Disabled bool   `json:"disabled"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	h.Key, h.Value, h.Enabled = aux.Key, aux.Value, !aux.Disabled
+	return nil
+}
+
+type Body struct {
+	Mode       string       `json:"mode"`
+	Raw        string       `json:"raw"`
+	FormData   []FormField  `json:"formdata"`
+	URLEncoded []FormField  `json:"urlencoded"`
+	GraphQL    *GraphQLBody `json:"graphql"`
+}
+
+// FormField is shared between the "formdata" and "urlencoded" body modes.
+// Type == "file" selects Src (a path on disk) instead of Value for
+// "formdata" fields.
+type FormField struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Type        string `json:"type"`
+	Src         string `json:"src"`
+	ContentType string `json:"contentType"`
+	Enabled     bool   `json:"-"`
+}
+
+func (f *FormField) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Key         string `json:"key"`
+		Value       string `json:"value"`
+		Type        string `json:"type"`
+		Src         string `json:"src"`
+		ContentType string `json:"contentType"`
+		Disabled    bool   `json:"disabled"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	f.Key, f.Value, f.Type, f.Src, f.ContentType = aux.Key, aux.Value, aux.Type, aux.Src, aux.ContentType
+	f.Enabled = !aux.Disabled
+	return nil
+}
+
+type GraphQLBody struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Event holds a pre-request or test script, identified by Listen.
+type Event struct {
+	Listen string `json:"listen"`
+	Script Script `json:"script"`
+}
+
+type Script struct {
+	Type string   `json:"type"`
+	Exec []string `json:"exec"`
+}
+
+type Variable struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Type  string      `json:"type"`
+}
+
+// Auth mirrors the v2.1 `auth.<type>` array form: Type selects which of
+// the arrays is populated, each entry being a {key, value, type} triple.
+type Auth struct {
+	Type string `json:"type"`
+
+	Basic  AuthParams `json:"basic"`
+	Bearer AuthParams `json:"bearer"`
+	Apikey AuthParams `json:"apikey"`
+	Digest AuthParams `json:"digest"`
+	OAuth2 AuthParams `json:"oauth2"`
+	AWSv4  AuthParams `json:"awsv4"`
+	Hawk   AuthParams `json:"hawk"`
+	NTLM   AuthParams `json:"ntlm"`
+}
+
+type AuthParam struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Type  string      `json:"type"`
+}
+
+type AuthParams []AuthParam
+
+// Get returns the string value of the named param, or "" if it isn't set.
+func (p AuthParams) Get(key string) string {
+	for _, param := range p {
+		if param.Key == key {
+			return fmt.Sprintf("%v", param.Value)
+		}
+	}
+	return ""
+}
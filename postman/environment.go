@@ -0,0 +1,79 @@
+package postman
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+)
+
+// environmentFile is the shape Postman exports both environments and
+// globals in: a flat `values` array of {key, value, enabled} triples.
+type environmentFile struct {
+	Values []struct {
+		Key     string      `json:"key"`
+		Value   interface{} `json:"value"`
+		Enabled bool        `json:"enabled"`
+	} `json:"values"`
+}
+
+// LoadEnvironment parses the contents of a Postman environment or globals
+// export into a flat variable map suitable for Runner.InitialEnvironment /
+// Runner.InitialGlobals. It does not read the file itself, and no
+// command-line flag calls it.
+func LoadEnvironment(source []byte) (map[string]interface{}, error) {
+	var f environmentFile
+	if err := json.Unmarshal(source, &f); err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]interface{}, len(f.Values))
+	for _, v := range f.Values {
+		if !v.Enabled {
+			continue
+		}
+		vars[v.Key] = v.Value
+	}
+	return vars, nil
+}
+
+// LoadIterationData parses the contents of a CSV/JSON data file (Newman's
+// "data file") into one variable map per row, for Runner.IterationData, so
+// RunOnce can pick the row for the current iteration. It does not read the
+// file itself, and no command-line flag calls it. The format is sniffed
+// from the content: a top-level JSON array is parsed as JSON, anything else
+// as CSV with the first row as headers (Newman's more common format).
+func LoadIterationData(source []byte) ([]map[string]interface{}, error) {
+	trimmed := bytes.TrimSpace(source)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var rows []map[string]interface{}
+		if err := json.Unmarshal(trimmed, &rows); err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+	return loadIterationCSV(trimmed)
+}
+
+func loadIterationCSV(source []byte) ([]map[string]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(source))
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, key := range header {
+			if i < len(record) {
+				row[key] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,27 @@
+package postman
+
+import "regexp"
+
+var gqlOperationRe = regexp.MustCompile(`(?:query|mutation|subscription)\s+(\w+)`)
+
+// graphqlOperationName extracts the operation name from a graphql body
+// mode query, e.g. "GetUser" out of
+// `query GetUser($id: ID!) { ... }`. Anonymous operations return "".
+func graphqlOperationName(query string) string {
+	m := gqlOperationRe.FindStringSubmatch(query)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// graphqlResponse is the subset of a GraphQL response envelope the runner
+// needs to turn `errors[]` into error samples.
+type graphqlResponse struct {
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code string `json:"code"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
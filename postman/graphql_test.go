@@ -0,0 +1,126 @@
+package postman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGraphqlOperationName(t *testing.T) {
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`query GetUser($id: ID!) { user(id: $id) { name } }`, "GetUser"},
+		{`mutation CreateUser($name: String!) { createUser(name: $name) { id } }`, "CreateUser"},
+		{`subscription OnMessage { message { body } }`, "OnMessage"},
+		{`{ user(id: 1) { name } }`, ""},
+	}
+	for _, c := range cases {
+		if got := graphqlOperationName(c.query); got != c.want {
+			t.Errorf("graphqlOperationName(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
+
+func TestGraphqlResponseErrorsDecode(t *testing.T) {
+	raw := `{
+		"data": null,
+		"errors": [
+			{"message": "not found", "extensions": {"code": "NOT_FOUND"}},
+			{"message": "denied", "extensions": {"code": "FORBIDDEN"}}
+		]
+	}`
+	var res graphqlResponse
+	if err := json.Unmarshal([]byte(raw), &res); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(res.Errors) != 2 {
+		t.Fatalf("got %d errors, want 2", len(res.Errors))
+	}
+	if res.Errors[0].Extensions.Code != "NOT_FOUND" || res.Errors[1].Extensions.Code != "FORBIDDEN" {
+		t.Fatalf("unexpected error codes: %+v", res.Errors)
+	}
+}
+
+// TestRunRequestGraphQLEncodesQueryAndVariables drives a full graphql-mode
+// request through runRequest and checks the server actually receives the
+// {"query": ..., "variables": ...} envelope with a JSON content type.
+func TestRunRequestGraphQLEncodesQueryAndVariables(t *testing.T) {
+	var gotBody map[string]interface{}
+	var gotContentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotContentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			t.Errorf("decoding request body: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data":{"user":{"name":"ok"}}}`))
+	}))
+	defer srv.Close()
+
+	u := newFullTestVU()
+	item := Item{
+		Request: Request{
+			Method: "POST",
+			URL:    srv.URL,
+			Body: Body{
+				Mode: "graphql",
+				GraphQL: &GraphQLBody{
+					Query:     `query GetUser($id: ID!) { user(id: $id) { name } }`,
+					Variables: map[string]interface{}{"id": "42"},
+				},
+			},
+		},
+	}
+
+	if err := u.runRequest(context.Background(), item, Auth{}); err != nil {
+		t.Fatalf("runRequest: %v", err)
+	}
+
+	if gotContentType != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", gotContentType)
+	}
+	if gotBody["query"] == nil {
+		t.Fatal("request body missing query")
+	}
+	vars, ok := gotBody["variables"].(map[string]interface{})
+	if !ok || vars["id"] != "42" {
+		t.Fatalf("request body variables = %v, want {id: 42}", gotBody["variables"])
+	}
+}
+
+// TestRunRequestGraphQLErrorsDoNotFailRequest exercises the errors[] ->
+// mErrors tagging path: a 2xx response whose GraphQL envelope carries
+// errors should not fail the request, so this only checks that runRequest
+// returns no error. The mErrors samples themselves aren't retrievable off
+// *stats.Collector from this package; decoding of the error codes the tag
+// is taken from is covered by TestGraphqlResponseErrorsDecode.
+func TestRunRequestGraphQLErrorsDoNotFailRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"data":null,"errors":[{"message":"nope","extensions":{"code":"NOT_FOUND"}}]}`))
+	}))
+	defer srv.Close()
+
+	u := newFullTestVU()
+	item := Item{
+		Request: Request{
+			Method: "POST",
+			URL:    srv.URL,
+			Body: Body{
+				Mode:    "graphql",
+				GraphQL: &GraphQLBody{Query: `query Q { x }`},
+			},
+		},
+	}
+
+	if err := u.runRequest(context.Background(), item, Auth{}); err != nil {
+		t.Fatalf("runRequest: %v", err)
+	}
+}
@@ -6,21 +6,27 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/loadimpact/speedboat/lib"
+	"github.com/loadimpact/speedboat/postman/capture"
+	"github.com/loadimpact/speedboat/postman/sandbox"
 	"github.com/loadimpact/speedboat/stats"
 	"golang.org/x/net/context"
 	"io"
 	"io/ioutil"
 	"math"
-	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	mRequests = stats.Stat{Name: "requests", Type: stats.HistogramType, Intent: stats.TimeIntent}
 	mErrors   = stats.Stat{Name: "errors", Type: stats.CounterType}
+	mChecks   = stats.Stat{Name: "checks", Type: stats.CounterType}
+	mTimeouts = stats.Stat{Name: "timeouts", Type: stats.CounterType}
 )
 
 type ErrorWithLineNumber struct {
@@ -32,14 +38,52 @@ func (e ErrorWithLineNumber) Error() string {
 	return fmt.Sprintf("%s (line %d)", e.Wrapped.Error(), e.Line)
 }
 
+// Runner owns the parsed collection plus the variable state that's shared
+// (read-only, after setup) by every VU: the initial globals/environment
+// loaded from file and, if given, a row of iteration data per run.
 type Runner struct {
 	Collection Collection
+
+	InitialGlobals     map[string]interface{}
+	InitialEnvironment map[string]interface{}
+	IterationData      []map[string]interface{}
+
+	// ChunkSize and UploadWorkers configure chunked uploads (see
+	// uploadChunked); zero means DefaultChunkSize/DefaultUploadWorkers.
+	ChunkSize     int64
+	UploadWorkers int
+
+	// Capture, if set, mirrors a sample of request/response pairs to an
+	// object store; see CaptureConfig and maybeCapture.
+	Capture *CaptureConfig
+
+	// RequestTimeout bounds a single request when the collection doesn't
+	// set its own `timeout` variable (in milliseconds); see requestTimeout.
+	RequestTimeout time.Duration
 }
 
 type VU struct {
 	Runner    *Runner
 	Client    http.Client
 	Collector *stats.Collector
+	Scope     *Scope
+
+	iteration int64
+
+	// authMu guards digestCache, oauthCache and ntlmClient: runItem only
+	// ever touches them from one goroutine, but uploadChunked's worker
+	// pool calls applyAuth concurrently for the same VU.
+	authMu      sync.Mutex
+	digestCache map[string]*digestChallenge
+	oauthCache  map[string]*oauthToken
+	ntlmClient  *http.Client
+
+	chunkMu      sync.Mutex
+	chunkOffsets map[string]int64
+
+	id           int64
+	capture      *capture.Sink
+	captureClose sync.Once
 }
 
 func New(source []byte) (*Runner, error) {
@@ -64,24 +108,77 @@ func New(source []byte) (*Runner, error) {
 }
 
 func (r *Runner) NewVU() (lib.VU, error) {
+	scope := NewScope()
+	for k, v := range r.InitialGlobals {
+		scope.Globals[k] = v
+	}
+	for k, v := range r.InitialEnvironment {
+		scope.Environment[k] = v
+	}
+	for _, v := range r.Collection.Variable {
+		scope.Collection[v.Key] = v.Value
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
 	return &VU{
 		Runner: r,
 		Client: http.Client{
 			Transport: &http.Transport{
 				MaxIdleConnsPerHost: math.MaxInt32,
+				DialContext:         dialer.DialContext,
 			},
 		},
-		Collector: stats.NewCollector(),
+		Collector:    stats.NewCollector(),
+		Scope:        scope,
+		digestCache:  make(map[string]*digestChallenge),
+		oauthCache:   make(map[string]*oauthToken),
+		chunkOffsets: make(map[string]int64),
 	}, nil
 }
 
 func (u *VU) Reconfigure(id int64) error {
+	u.id = id
+	if u.Runner.Capture != nil {
+		cfg := *u.Runner.Capture
+		cfg.VUID = id
+		u.capture = capture.New(cfg)
+	}
 	return nil
 }
 
+// watchCaptureClose closes u.capture (flushing any pending batch and
+// stopping its age-based flush loop) once ctx - the long-lived context
+// RunOnce is driven with for the life of the VU - is cancelled, which is
+// the only end-of-run signal a VU sees. It's started once per VU, since
+// RunOnce is called again every iteration but ctx is the same for all of
+// them.
+func (u *VU) watchCaptureClose(ctx context.Context) {
+	if u.capture == nil {
+		return
+	}
+	u.captureClose.Do(func() {
+		go func() {
+			<-ctx.Done()
+			if err := u.capture.Close(); err != nil {
+				log.WithError(err).Warn("Failed to flush capture sink")
+			}
+		}()
+	})
+}
+
 func (u *VU) RunOnce(ctx context.Context) error {
+	u.watchCaptureClose(ctx)
+
+	if len(u.Runner.IterationData) > 0 {
+		row := u.Runner.IterationData[int(u.iteration)%len(u.Runner.IterationData)]
+		for k, v := range row {
+			u.Scope.Iteration[k] = v
+		}
+	}
+	u.iteration++
+
 	for _, item := range u.Runner.Collection.Item {
-		if err := u.runItem(item, u.Runner.Collection.Auth); err != nil {
+		if err := u.runItem(ctx, item, u.Runner.Collection.Auth); err != nil {
 			return err
 		}
 	}
@@ -89,78 +186,327 @@ func (u *VU) RunOnce(ctx context.Context) error {
 	return nil
 }
 
-func (u *VU) runItem(i Item, a Auth) error {
+func (u *VU) runItem(ctx context.Context, i Item, a Auth) error {
 	if i.Auth.Type != "" {
 		a = i.Auth
 	}
 
+	// Folder variables only apply to i and its own subtree; restore the
+	// layer once we're done so they don't leak into siblings or later
+	// folders for the rest of the run.
+	folderSnapshot := u.Scope.SnapshotFolder()
+	defer u.Scope.RestoreFolder(folderSnapshot)
+
+	for _, v := range i.Variable {
+		u.Scope.Folder[v.Key] = v.Value
+	}
+
 	if i.Request.URL != "" {
-		var buffer *bytes.Buffer
-		switch i.Request.Body.Mode {
-		case "raw":
-			buffer = bytes.NewBufferString(i.Request.Body.Raw)
-		case "formdata":
-			buffer = &bytes.Buffer{}
-			w := multipart.NewWriter(buffer)
-			for _, field := range i.Request.Body.FormData {
-				if !field.Enabled {
-					continue
-				}
+		if err := u.runRequest(ctx, i, a); err != nil {
+			return err
+		}
+	}
 
-				if err := w.WriteField(field.Key, field.Value); err != nil {
-					return err
-				}
+	for _, item := range i.Item {
+		if err := u.runItem(ctx, item, a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requestTimeout resolves the deadline a single request should run
+// under: the collection's own `timeout` variable (in milliseconds) takes
+// priority over Runner.RequestTimeout, matching how Postman/Newman let a
+// collection override the CLI's default.
+func (u *VU) requestTimeout() (time.Duration, bool) {
+	if v, ok := u.Scope.Get("timeout"); ok {
+		if ms := toMillis(v); ms > 0 {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+	if u.Runner.RequestTimeout > 0 {
+		return u.Runner.RequestTimeout, true
+	}
+	return 0, false
+}
+
+func toMillis(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case int:
+		return float64(x)
+	case string:
+		f, _ := strconv.ParseFloat(x, 64)
+		return f
+	}
+	return 0
+}
+
+// runRequest sends i.Request once (its scripts, variable substitution,
+// auth and stats), or, for a chunked-upload-annotated formdata file
+// field, drives the whole chunked transfer instead - see uploadChunked.
+// ctx is derived per-request from Runner.RequestTimeout/the collection's
+// `timeout` variable, so a cancelled run or an expired deadline unblocks
+// the in-flight call instead of waiting out the OS socket timeout.
+func (u *VU) runRequest(ctx context.Context, i Item, a Auth) error {
+	// Local variables (pm.variables.set) are scoped to a single request's
+	// prerequest+test scripts, not the VU's whole lifetime.
+	u.Scope.ResetLocal()
+
+	if err := u.runScripts(i, "prerequest", i.Request.Method, i.Request.URL, nil, nil); err != nil {
+		return err
+	}
+
+	method := u.Scope.Substitute(i.Request.Method)
+	reqURL := u.Scope.Substitute(i.Request.URL)
+
+	headers := make(map[string]string, len(i.Request.Header))
+	for _, h := range i.Request.Header {
+		if !h.Enabled {
+			continue
+		}
+		headers[u.Scope.Substitute(h.Key)] = u.Scope.Substitute(h.Value)
+	}
+
+	if d, ok := u.requestTimeout(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	if i.Request.Body.Mode == "formdata" && isChunkedUpload(headers) {
+		if field, ok := firstFileField(i.Request.Body.FormData); ok {
+			return u.uploadChunked(ctx, method, reqURL, headers, field, a)
+		}
+	}
+
+	var (
+		body         io.Reader
+		bodyBytes    []byte
+		contentType  string
+		gqlOperation string
+	)
+	switch i.Request.Body.Mode {
+	case "raw":
+		bodyBytes = []byte(u.Scope.Substitute(i.Request.Body.Raw))
+		body = bytes.NewReader(bodyBytes)
+	case "formdata":
+		if needsRequestBody(a) {
+			// awsv4/hawk sign the payload itself, so the body has to be
+			// materialized up front instead of streamed unread.
+			b, ct, err := u.buildFormDataBuffer(i.Request.Body)
+			if err != nil {
+				return err
 			}
-		case "urlencoded":
-			v := make(url.Values)
-			for _, field := range i.Request.Body.URLEncoded {
-				if !field.Enabled {
-					continue
-				}
-				v[field.Key] = append(v[field.Key], field.Value)
+			bodyBytes, body, contentType = b, bytes.NewReader(b), ct
+		} else {
+			pr, ct, err := u.buildFormData(i.Request.Body)
+			if err != nil {
+				return err
 			}
-			buffer = bytes.NewBufferString(v.Encode())
+			body, contentType = pr, ct
 		}
+	case "urlencoded":
+		v := make(url.Values)
+		for _, field := range i.Request.Body.URLEncoded {
+			if !field.Enabled {
+				continue
+			}
+			v[field.Key] = append(v[field.Key], u.Scope.Substitute(field.Value))
+		}
+		bodyBytes = []byte(v.Encode())
+		body = bytes.NewReader(bodyBytes)
+	case "graphql":
+		if gql := i.Request.Body.GraphQL; gql != nil {
+			query := u.Scope.Substitute(gql.Query)
+			gqlOperation = graphqlOperationName(query)
 
-		req, err := http.NewRequest(i.Request.Method, i.Request.URL, buffer)
-		if err != nil {
-			return err
+			b, err := json.Marshal(map[string]interface{}{
+				"query":     query,
+				"variables": gql.Variables,
+			})
+			if err != nil {
+				return err
+			}
+			bodyBytes = b
+			body = bytes.NewReader(bodyBytes)
+			contentType = "application/json"
 		}
+	}
 
-		startTime := time.Now()
-		res, err := u.Client.Do(req)
-		duration := time.Since(startTime)
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if contentType != "" && (i.Request.Body.Mode == "formdata" || req.Header.Get("Content-Type") == "") {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if err := u.applyAuth(req, a, bodyBytes); err != nil {
+		return err
+	}
+
+	client := u.clientFor(a)
+	startTime := time.Now()
+	res, err := client.Do(req)
+	duration := time.Since(startTime)
+
+	status := 0
+	var resBody []byte
+	if err == nil {
+		status = res.StatusCode
+		resBody, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
 
-		status := 0
-		if err == nil {
-			status = res.StatusCode
-			io.Copy(ioutil.Discard, res.Body)
-			res.Body.Close()
+		if status == http.StatusUnauthorized && a.Type == "digest" {
+			if c := u.captureDigestChallenge(req.URL.Host, res.Header.Get("WWW-Authenticate")); c != nil {
+				retry, rerr := http.NewRequest(method, reqURL, bytes.NewReader(bodyBytes))
+				if rerr != nil {
+					return rerr
+				}
+				retry = retry.WithContext(ctx)
+				for k, v := range headers {
+					retry.Header.Set(k, v)
+				}
+				if rerr := u.setDigestHeader(retry, a, c); rerr != nil {
+					return rerr
+				}
+
+				res, err = client.Do(retry)
+				duration = time.Since(startTime)
+				if err == nil {
+					status = res.StatusCode
+					resBody, _ = ioutil.ReadAll(res.Body)
+					res.Body.Close()
+				}
+			}
+		}
+	}
+
+	tags := stats.Tags{"method": method, "url": reqURL, "status": status}
+	if gqlOperation != "" {
+		tags["operation"] = gqlOperation
+	}
+	u.Collector.Add(stats.Sample{
+		Stat:   &mRequests,
+		Tags:   tags,
+		Values: stats.Values{"duration": float64(duration)},
+	})
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr == context.DeadlineExceeded {
+			log.WithError(ctxErr).Warn("Request timed out")
+			u.Collector.Add(stats.Sample{
+				Stat:   &mTimeouts,
+				Tags:   tags,
+				Values: stats.Value(1),
+			})
+			u.maybeCapture(status, true, method, reqURL, headers, bodyBytes, nil, nil)
+			return ctxErr
 		}
 
-		tags := stats.Tags{"method": i.Request.Method, "url": i.Request.URL, "status": status}
+		log.WithError(err).Error("Request error")
 		u.Collector.Add(stats.Sample{
-			Stat:   &mRequests,
+			Stat:   &mErrors,
 			Tags:   tags,
-			Values: stats.Values{"duration": float64(duration)},
+			Values: stats.Value(1),
 		})
+		u.maybeCapture(status, true, method, reqURL, headers, bodyBytes, nil, nil)
+		return err
+	}
+
+	resHeaders := make(map[string]string, len(res.Header))
+	for k := range res.Header {
+		resHeaders[k] = res.Header.Get(k)
+	}
+	u.maybeCapture(status, false, method, reqURL, headers, bodyBytes, resHeaders, resBody)
+
+	if i.Request.Body.Mode == "graphql" && status >= 200 && status < 300 {
+		var gqlRes graphqlResponse
+		if jsonErr := json.Unmarshal(resBody, &gqlRes); jsonErr == nil {
+			for _, gqlErr := range gqlRes.Errors {
+				errTags := stats.Tags{"method": method, "url": reqURL, "status": status, "graphql_error_type": gqlErr.Extensions.Code}
+				u.Collector.Add(stats.Sample{
+					Stat:   &mErrors,
+					Tags:   errTags,
+					Values: stats.Value(1),
+				})
+			}
+		}
+	}
+
+	sbRes := &sandbox.Response{
+		Code:           res.StatusCode,
+		Status:         res.Status,
+		Headers:        resHeaders,
+		Body:           string(resBody),
+		ResponseTimeMs: float64(duration) / float64(time.Millisecond),
+	}
+	return u.runScripts(i, "test", method, reqURL, headers, sbRes)
+}
 
+// runScripts evaluates every event on i matching listen, surfacing
+// pm.test() assertions as checks samples. A script that throws is
+// treated like any other fatal request-processing error.
+func (u *VU) runScripts(i Item, listen, method, reqURL string, reqHeaders map[string]string, res *sandbox.Response) error {
+	for _, ev := range i.Event {
+		if ev.Listen != listen || ev.Script.Type != "" && ev.Script.Type != "text/javascript" {
+			continue
+		}
+		script := strings.Join(ev.Script.Exec, "\n")
+		if strings.TrimSpace(script) == "" {
+			continue
+		}
+
+		sb := sandbox.New()
+		assertions, err := sb.Run(sandbox.RunOptions{
+			Script:      script,
+			Globals:     scopeStore{u.Scope, u.Scope.SetGlobal},
+			Environment: scopeStore{u.Scope, u.Scope.SetEnvironment},
+			Variables:   scopeStore{u.Scope, u.Scope.SetLocal},
+			Request: &sandbox.Request{
+				Method:  method,
+				URL:     reqURL,
+				Headers: reqHeaders,
+			},
+			Response: res,
+		})
 		if err != nil {
-			log.WithError(err).Error("Request error")
+			return err
+		}
+
+		for _, a := range assertions {
+			tags := stats.Tags{"name": a.Name, "passed": a.Passed}
 			u.Collector.Add(stats.Sample{
-				Stat:   &mErrors,
+				Stat:   &mChecks,
 				Tags:   tags,
 				Values: stats.Value(1),
 			})
-			return err
+			if !a.Passed {
+				log.WithField("name", a.Name).WithField("error", a.Error).Warn("Check failed")
+			}
 		}
 	}
+	return nil
+}
 
-	for _, item := range i.Item {
-		if err := u.runItem(item, a); err != nil {
-			return err
-		}
-	}
+// scopeStore adapts Scope's layered Get plus a single layer's setter into
+// the sandbox.Store a pm.* namespace talks to.
+type scopeStore struct {
+	scope *Scope
+	set   func(key string, value interface{})
+}
 
-	return nil
-}
\ No newline at end of file
+func (s scopeStore) Get(key string) (interface{}, bool) {
+	return s.scope.Get(key)
+}
+
+func (s scopeStore) Set(key string, value interface{}) {
+	s.set(key, value)
+}
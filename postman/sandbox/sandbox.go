@@ -0,0 +1,287 @@
+// Package sandbox runs Postman pre-request and test scripts in an
+// embedded JS runtime, exposing the subset of the `pm.*` API that real
+// collections rely on: pm.request, pm.response, pm.environment,
+// pm.globals, pm.variables, pm.test and pm.expect.
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// Store is a get/set variable layer, e.g. the environment or globals
+// scope of a postman.Scope. Sets performed by a script are applied
+// immediately so later pm.*.get calls in the same script observe them.
+type Store interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, value interface{})
+}
+
+// Request is the read-only view of the outgoing request a script can
+// inspect. Changes a script makes to pm.request are not applied to the
+// request that is sent.
+type Request struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    string
+}
+
+// Response is the view of a completed response a test script can
+// inspect. It is nil for pre-request scripts.
+type Response struct {
+	Code           int
+	Status         string
+	Headers        map[string]string
+	Body           string
+	ResponseTimeMs float64
+}
+
+// Assertion is one pm.test(name, fn) invocation's outcome.
+type Assertion struct {
+	Name   string
+	Passed bool
+	Error  string
+}
+
+// RunOptions bundles everything a single script evaluation needs.
+type RunOptions struct {
+	Script      string
+	Globals     Store
+	Environment Store
+	Variables   Store
+	Request     *Request
+	Response    *Response
+}
+
+// Sandbox is a disposable JS VM; the runner creates one per script
+// invocation so that state from one item's scripts never leaks into the
+// next.
+type Sandbox struct {
+	vm         *goja.Runtime
+	assertions []Assertion
+}
+
+func New() *Sandbox {
+	return &Sandbox{vm: goja.New()}
+}
+
+// Run evaluates opts.Script and returns the pm.test assertions it
+// recorded. A script that throws fails the run the same way a failed
+// HTTP request would; a failed pm.test assertion does not stop the
+// script, matching how Newman behaves.
+func (sb *Sandbox) Run(opts RunOptions) ([]Assertion, error) {
+	sb.assertions = nil
+
+	pm := sb.vm.NewObject()
+	pm.Set("environment", sb.store(opts.Environment))
+	pm.Set("globals", sb.store(opts.Globals))
+	pm.Set("variables", sb.store(opts.Variables))
+	pm.Set("request", sb.request(opts.Request))
+	pm.Set("response", sb.response(opts.Response))
+	pm.Set("test", sb.test)
+	pm.Set("expect", sb.expect)
+
+	sb.vm.Set("pm", pm)
+	// Newman-era collections (pre-v2.1 "postman" sandbox global) use
+	// these interchangeably with pm.*, so alias them for compatibility.
+	sb.vm.Set("postman", pm)
+	sb.vm.Set("tests", sb.vm.NewObject())
+
+	if _, err := sb.vm.RunString(opts.Script); err != nil {
+		return sb.assertions, err
+	}
+	return sb.assertions, nil
+}
+
+func (sb *Sandbox) store(s Store) *goja.Object {
+	o := sb.vm.NewObject()
+	if s == nil {
+		return o
+	}
+	o.Set("get", func(key string) interface{} {
+		v, ok := s.Get(key)
+		if !ok {
+			return goja.Undefined()
+		}
+		return v
+	})
+	o.Set("set", func(key string, value interface{}) {
+		s.Set(key, value)
+	})
+	o.Set("unset", func(key string) {
+		s.Set(key, nil)
+	})
+	return o
+}
+
+func (sb *Sandbox) request(r *Request) *goja.Object {
+	o := sb.vm.NewObject()
+	if r == nil {
+		return o
+	}
+	o.Set("method", r.Method)
+	o.Set("url", r.URL)
+	o.Set("body", r.Body)
+	headers := sb.vm.NewObject()
+	for k, v := range r.Headers {
+		headers.Set(k, v)
+	}
+	headers.Set("get", func(key string) interface{} {
+		if v, ok := r.Headers[key]; ok {
+			return v
+		}
+		return goja.Undefined()
+	})
+	o.Set("headers", headers)
+	return o
+}
+
+func (sb *Sandbox) response(r *Response) *goja.Object {
+	o := sb.vm.NewObject()
+	if r == nil {
+		return o
+	}
+	o.Set("code", r.Code)
+	o.Set("status", r.Status)
+	o.Set("responseTime", r.ResponseTimeMs)
+	headers := sb.vm.NewObject()
+	for k, v := range r.Headers {
+		headers.Set(k, v)
+	}
+	o.Set("headers", headers)
+	o.Set("text", func() string { return r.Body })
+	o.Set("json", func() (interface{}, error) {
+		var v interface{}
+		if err := json.Unmarshal([]byte(r.Body), &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	})
+	return o
+}
+
+func (sb *Sandbox) test(name string, fn goja.Callable) {
+	_, err := fn(goja.Undefined())
+	a := Assertion{Name: name, Passed: err == nil}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	sb.assertions = append(sb.assertions, a)
+}
+
+// expect implements the slice of the chai BDD API that Postman test
+// scripts overwhelmingly use: to.equal, to.eql, to.include, to.be.above,
+// to.be.below and the to.be.ok/true/false/null predicates (each called as
+// a function). Other chai assertions, such as to.be.undefined, are not
+// provided.
+func (sb *Sandbox) expect(actual interface{}) *goja.Object {
+	o := sb.vm.NewObject()
+
+	fail := func(format string, args ...interface{}) {
+		panic(sb.vm.NewGoError(fmt.Errorf(format, args...)))
+	}
+
+	to := sb.vm.NewObject()
+	to.Set("equal", func(expected interface{}) { sb.assertEqual(actual, expected, fail, false) })
+	to.Set("eql", func(expected interface{}) { sb.assertEqual(actual, expected, fail, true) })
+	to.Set("include", func(expected interface{}) { sb.assertInclude(actual, expected, fail) })
+
+	be := sb.vm.NewObject()
+	be.Set("ok", func() {
+		if isFalsy(actual) {
+			fail("expected %v to be truthy", actual)
+		}
+	})
+	be.Set("true", func() {
+		if v, ok := actual.(bool); !ok || !v {
+			fail("expected %v to be true", actual)
+		}
+	})
+	be.Set("false", func() {
+		if v, ok := actual.(bool); !ok || v {
+			fail("expected %v to be false", actual)
+		}
+	})
+	be.Set("null", func() {
+		if actual != nil {
+			fail("expected %v to be null", actual)
+		}
+	})
+	be.Set("above", func(n float64) {
+		if !(toFloat(actual) > n) {
+			fail("expected %v to be above %v", actual, n)
+		}
+	})
+	be.Set("below", func(n float64) {
+		if !(toFloat(actual) < n) {
+			fail("expected %v to be below %v", actual, n)
+		}
+	})
+	to.Set("be", be)
+
+	o.Set("to", to)
+	return o
+}
+
+func (sb *Sandbox) assertEqual(actual, expected interface{}, fail func(string, ...interface{}), deep bool) {
+	if deep {
+		ab, _ := json.Marshal(actual)
+		eb, _ := json.Marshal(expected)
+		if string(ab) != string(eb) {
+			fail("expected %v to deeply equal %v", actual, expected)
+		}
+		return
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(expected) || fmt.Sprintf("%T", actual) != fmt.Sprintf("%T", expected) {
+		fail("expected %v to equal %v", actual, expected)
+	}
+}
+
+func (sb *Sandbox) assertInclude(actual, expected interface{}, fail func(string, ...interface{})) {
+	switch a := actual.(type) {
+	case string:
+		if s, ok := expected.(string); ok && strings.Contains(a, s) {
+			return
+		}
+	case []interface{}:
+		for _, v := range a {
+			if fmt.Sprint(v) == fmt.Sprint(expected) {
+				return
+			}
+		}
+	}
+	fail("expected %v to include %v", actual, expected)
+}
+
+func isFalsy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !x
+	case string:
+		return x == ""
+	case int64:
+		return x == 0
+	case float64:
+		return x == 0
+	}
+	return false
+}
+
+func toFloat(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
+		return x
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	}
+	return 0
+}
+
@@ -0,0 +1,130 @@
+package sandbox
+
+import "testing"
+
+// memStore is a minimal in-memory Store for exercising pm.environment/
+// pm.globals/pm.variables without pulling in postman.Scope.
+type memStore map[string]interface{}
+
+func (m memStore) Get(key string) (interface{}, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+func (m memStore) Set(key string, value interface{}) {
+	m[key] = value
+}
+
+func TestPmTestRecordsPassingAndFailingAssertions(t *testing.T) {
+	sb := New()
+	assertions, err := sb.Run(RunOptions{
+		Script: `
+			pm.test("passes", function () { pm.expect(1 + 1).to.equal(2); });
+			pm.test("fails", function () { pm.expect(1).to.equal(2); });
+		`,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(assertions) != 2 {
+		t.Fatalf("got %d assertions, want 2", len(assertions))
+	}
+	if !assertions[0].Passed {
+		t.Errorf("assertion %q should have passed, error=%q", assertions[0].Name, assertions[0].Error)
+	}
+	if assertions[1].Passed {
+		t.Errorf("assertion %q should have failed", assertions[1].Name)
+	}
+	if assertions[1].Error == "" {
+		t.Error("failing assertion has no Error recorded")
+	}
+}
+
+func TestPmExpectVariants(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+	}{
+		{"eql deep equal", `pm.test("t", function () { pm.expect({a:1}).to.eql({a:1}); })`},
+		{"include string", `pm.test("t", function () { pm.expect("hello world").to.include("world"); })`},
+		{"be.above", `pm.test("t", function () { pm.expect(5).to.be.above(1); })`},
+		{"be.below", `pm.test("t", function () { pm.expect(5).to.be.below(10); })`},
+		{"be.ok", `pm.test("t", function () { pm.expect("x").to.be.ok(); })`},
+		{"be.true", `pm.test("t", function () { pm.expect(true).to.be.true(); })`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sb := New()
+			assertions, err := sb.Run(RunOptions{Script: c.script})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if len(assertions) != 1 || !assertions[0].Passed {
+				t.Fatalf("expected one passing assertion, got %+v", assertions)
+			}
+		})
+	}
+}
+
+func TestPmEnvironmentAndGlobalsPersistWrites(t *testing.T) {
+	env := memStore{"existing": "env-value"}
+	globals := memStore{}
+
+	sb := New()
+	_, err := sb.Run(RunOptions{
+		Script: `
+			pm.globals.set("fromScript", pm.environment.get("existing"));
+			pm.environment.set("written", "yes");
+		`,
+		Environment: env,
+		Globals:     globals,
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if v, _ := globals.Get("fromScript"); v != "env-value" {
+		t.Fatalf("globals[fromScript] = %v, want env-value", v)
+	}
+	if v, _ := env.Get("written"); v != "yes" {
+		t.Fatalf("environment[written] = %v, want yes", v)
+	}
+}
+
+func TestSandboxScriptThrowReturnsError(t *testing.T) {
+	sb := New()
+	_, err := sb.Run(RunOptions{Script: `throw new Error("boom")`})
+	if err == nil {
+		t.Fatal("expected an error from a throwing script")
+	}
+}
+
+func TestPmRequestAndResponseExposedToScript(t *testing.T) {
+	globals := memStore{}
+	sb := New()
+	_, err := sb.Run(RunOptions{
+		Script: `
+			pm.globals.set("method", pm.request.method);
+			pm.globals.set("status", pm.response.code);
+			pm.globals.set("body", pm.response.text());
+		`,
+		Globals: globals,
+		Request: &Request{Method: "POST", URL: "http://example.com/"},
+		Response: &Response{
+			Code:   201,
+			Status: "201 Created",
+			Body:   `{"ok":true}`,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if v, _ := globals.Get("method"); v != "POST" {
+		t.Fatalf("method = %v, want POST", v)
+	}
+	if v, _ := globals.Get("status"); v != int64(201) && v != 201 {
+		t.Fatalf("status = %v, want 201", v)
+	}
+	if v, _ := globals.Get("body"); v != `{"ok":true}` {
+		t.Fatalf("body = %v, want the raw response body", v)
+	}
+}
@@ -0,0 +1,128 @@
+package postman
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+var varRe = regexp.MustCompile(`{{([^{}]+)}}`)
+
+// Scope is the per-VU merged variable namespace scripts and substitution
+// read and write through. Lookup order, lowest to highest precedence, is
+// globals < environment < collection < folder < iteration < local, matching
+// Newman/the Postman app.
+type Scope struct {
+	mu sync.Mutex
+
+	Globals     map[string]interface{}
+	Environment map[string]interface{}
+	Collection  map[string]interface{}
+	Folder      map[string]interface{}
+	Iteration   map[string]interface{}
+	Local       map[string]interface{}
+}
+
+func NewScope() *Scope {
+	return &Scope{
+		Globals:     make(map[string]interface{}),
+		Environment: make(map[string]interface{}),
+		Collection:  make(map[string]interface{}),
+		Folder:      make(map[string]interface{}),
+		Iteration:   make(map[string]interface{}),
+		Local:       make(map[string]interface{}),
+	}
+}
+
+// layers returns the maps in ascending precedence order.
+func (s *Scope) layers() []map[string]interface{} {
+	return []map[string]interface{}{s.Globals, s.Environment, s.Collection, s.Folder, s.Iteration, s.Local}
+}
+
+// Get resolves a variable, walking the layers from lowest to highest
+// precedence and keeping the last (highest-precedence) hit.
+func (s *Scope) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		value interface{}
+		found bool
+	)
+	for _, layer := range s.layers() {
+		if v, ok := layer[key]; ok {
+			value, found = v, true
+		}
+	}
+	return value, found
+}
+
+// SetEnvironment and SetGlobal are the two layers scripts can persist to
+// via pm.environment.set/pm.globals.set, so that a later request in the
+// same iteration (or a later iteration) sees the write.
+func (s *Scope) SetEnvironment(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Environment[key] = value
+}
+
+func (s *Scope) SetGlobal(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Globals[key] = value
+}
+
+func (s *Scope) SetLocal(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Local[key] = value
+}
+
+// SnapshotFolder returns a copy of the current folder-scope layer. runItem
+// restores it after recursing into an item's children, so a folder's
+// variables don't leak into its siblings or the rest of the run.
+func (s *Scope) SnapshotFolder() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := make(map[string]interface{}, len(s.Folder))
+	for k, v := range s.Folder {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+// RestoreFolder replaces the folder-scope layer with snapshot, undoing
+// whatever a folder's Item subtree added to it.
+func (s *Scope) RestoreFolder(snapshot map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Folder = snapshot
+}
+
+// ResetLocal clears the local-scope layer. pm.variables.set is only
+// supposed to last for the request currently running, not the VU's whole
+// lifetime, so runRequest calls this before every request.
+func (s *Scope) ResetLocal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Local = make(map[string]interface{})
+}
+
+// Substitute replaces every `{{var}}` occurrence in s with its resolved
+// value. Unresolved variables are left untouched, matching Newman.
+func (s *Scope) Substitute(in string) string {
+	return varRe.ReplaceAllStringFunc(in, func(match string) string {
+		key := varRe.FindStringSubmatch(match)[1]
+		if v, ok := s.Get(key); ok {
+			return toString(v)
+		}
+		return match
+	})
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
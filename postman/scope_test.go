@@ -0,0 +1,148 @@
+package postman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestScopePrecedence(t *testing.T) {
+	s := NewScope()
+	s.Globals["v"] = "globals"
+	s.Environment["v"] = "environment"
+	s.Collection["v"] = "collection"
+	s.Folder["v"] = "folder"
+	s.Iteration["v"] = "iteration"
+	s.Local["v"] = "local"
+
+	if v, ok := s.Get("v"); !ok || v != "local" {
+		t.Fatalf("Get(v) = %v, %v, want local, true", v, ok)
+	}
+
+	s.Local = make(map[string]interface{})
+	if v, ok := s.Get("v"); !ok || v != "iteration" {
+		t.Fatalf("Get(v) without local = %v, %v, want iteration, true", v, ok)
+	}
+
+	s.Iteration = make(map[string]interface{})
+	if v, ok := s.Get("v"); !ok || v != "folder" {
+		t.Fatalf("Get(v) without iteration = %v, %v, want folder, true", v, ok)
+	}
+}
+
+func TestScopeSubstitute(t *testing.T) {
+	s := NewScope()
+	s.Environment["host"] = "example.com"
+	s.Local["id"] = 42
+
+	got := s.Substitute("https://{{host}}/users/{{id}}?missing={{nope}}")
+	want := "https://example.com/users/42?missing={{nope}}"
+	if got != want {
+		t.Fatalf("Substitute = %q, want %q", got, want)
+	}
+}
+
+func TestScopeSetEnvironmentAndGlobalPersist(t *testing.T) {
+	s := NewScope()
+	s.SetGlobal("g", "gv")
+	s.SetEnvironment("e", "ev")
+	s.SetLocal("l", "lv")
+
+	for key, want := range map[string]interface{}{"g": "gv", "e": "ev", "l": "lv"} {
+		if v, ok := s.Get(key); !ok || v != want {
+			t.Fatalf("Get(%q) = %v, %v, want %v, true", key, v, ok, want)
+		}
+	}
+}
+
+func TestScopeFolderSnapshotRestore(t *testing.T) {
+	s := NewScope()
+	s.Folder["outer"] = "outer-value"
+
+	snapshot := s.SnapshotFolder()
+	s.Folder["inner"] = "inner-value"
+
+	if v, ok := s.Get("inner"); !ok || v != "inner-value" {
+		t.Fatalf("Get(inner) before restore = %v, %v, want inner-value, true", v, ok)
+	}
+
+	s.RestoreFolder(snapshot)
+
+	if _, ok := s.Get("inner"); ok {
+		t.Fatal("inner variable survived RestoreFolder, want it gone")
+	}
+	if v, ok := s.Get("outer"); !ok || v != "outer-value" {
+		t.Fatalf("Get(outer) after restore = %v, %v, want outer-value, true", v, ok)
+	}
+}
+
+func TestScopeResetLocal(t *testing.T) {
+	s := NewScope()
+	s.SetLocal("temp", "value")
+	if _, ok := s.Get("temp"); !ok {
+		t.Fatal("expected temp to be set before ResetLocal")
+	}
+
+	s.ResetLocal()
+
+	if _, ok := s.Get("temp"); ok {
+		t.Fatal("expected temp to be cleared by ResetLocal")
+	}
+}
+
+// TestRunItemFolderVariablesDoNotLeakToSiblings exercises the actual bug:
+// a folder sets a variable visible to its own requests, but it must not be
+// visible once runItem has returned to a sibling folder. pm.variables.get
+// resolves through the full merged Scope (see scopeStore.Get), so a
+// prerequest script that reads the folder variable and stashes it as a
+// global is enough to observe what each leaf actually saw.
+func TestRunItemFolderVariablesDoNotLeakToSiblings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u := newFullTestVU()
+
+	leaf := func(name, stashKey string) Item {
+		return Item{
+			Name: name,
+			Event: []Event{{
+				Listen: "prerequest",
+				Script: Script{Exec: []string{
+					`pm.globals.set("` + stashKey + `", pm.variables.get("folderVar") || "MISSING")`,
+				}},
+			}},
+			Request: Request{Method: "GET", URL: srv.URL},
+		}
+	}
+
+	folderA := Item{
+		Name:     "A",
+		Variable: []Variable{{Key: "folderVar", Value: "A-value"}},
+		Item:     []Item{leaf("A/leaf", "seenInA")},
+	}
+	folderB := Item{
+		Name: "B",
+		Item: []Item{leaf("B/leaf", "seenInB")},
+	}
+
+	if err := u.runItem(context.Background(), folderA, Auth{}); err != nil {
+		t.Fatalf("runItem(folderA): %v", err)
+	}
+	if err := u.runItem(context.Background(), folderB, Auth{}); err != nil {
+		t.Fatalf("runItem(folderB): %v", err)
+	}
+
+	if got, ok := u.Scope.Get("seenInA"); !ok || got != "A-value" {
+		t.Fatalf("seenInA = %v, %v, want A-value, true", got, ok)
+	}
+	if got, ok := u.Scope.Get("seenInB"); !ok || got != "MISSING" {
+		t.Fatalf("seenInB = %v, %v, want MISSING, true (folderVar must not leak into sibling B)", got, ok)
+	}
+	if _, ok := u.Scope.Folder["folderVar"]; ok {
+		t.Fatal("folderVar still present on Scope.Folder after both folders returned")
+	}
+}
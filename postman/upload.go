@@ -0,0 +1,290 @@
+package postman
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/loadimpact/speedboat/stats"
+	"golang.org/x/net/context"
+)
+
+var mChunks = stats.Stat{Name: "upload_chunks", Type: stats.HistogramType, Intent: stats.TimeIntent}
+
+const (
+	// DefaultChunkSize is used when a request doesn't set Runner.ChunkSize.
+	DefaultChunkSize = 32 * 1024 * 1024
+	// DefaultUploadWorkers is used when a request doesn't set Runner.UploadWorkers.
+	DefaultUploadWorkers = 4
+)
+
+// isChunkedUpload reports whether headers ask for the chunked-upload body
+// mode via the `x-k6-upload: chunked` convention.
+func isChunkedUpload(headers map[string]string) bool {
+	for k, v := range headers {
+		if strings.EqualFold(k, "x-k6-upload") && strings.EqualFold(v, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+func firstFileField(fields []FormField) (FormField, bool) {
+	for _, f := range fields {
+		if f.Enabled && f.Type == "file" {
+			return f, true
+		}
+	}
+	return FormField{}, false
+}
+
+// buildFormData streams a "formdata" body's parts into an io.Pipe instead
+// of buffering them, so a file field the size of a whole upload doesn't
+// have to fit in memory. The returned Content-Type carries the boundary
+// multipart.Writer picked, and must be set on the request explicitly
+// since Go doesn't infer it from an io.Reader body.
+func (u *VU) buildFormData(body Body) (io.Reader, string, error) {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	contentType := w.FormDataContentType()
+
+	go func() {
+		var err error
+		defer func() {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			pw.CloseWithError(err)
+		}()
+
+		for _, field := range body.FormData {
+			if !field.Enabled {
+				continue
+			}
+			if field.Type == "file" {
+				if err = u.writeFormFile(w, field); err != nil {
+					return
+				}
+				continue
+			}
+			if err = w.WriteField(field.Key, u.Scope.Substitute(field.Value)); err != nil {
+				return
+			}
+		}
+	}()
+
+	return pr, contentType, nil
+}
+
+// buildFormDataBuffer builds a "formdata" body fully in memory instead of
+// streaming it, returning the encoded bytes alongside its Content-Type.
+// Unlike buildFormData, this is needed whenever the body must be signed or
+// HMAC'd before it goes out (awsv4, hawk), since that requires the actual
+// bytes up front rather than a stream runRequest hasn't read yet.
+func (u *VU) buildFormDataBuffer(body Body) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	contentType := w.FormDataContentType()
+
+	for _, field := range body.FormData {
+		if !field.Enabled {
+			continue
+		}
+		if field.Type == "file" {
+			if err := u.writeFormFile(w, field); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		if err := w.WriteField(field.Key, u.Scope.Substitute(field.Value)); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), contentType, nil
+}
+
+func (u *VU) writeFormFile(w *multipart.Writer, field FormField) error {
+	src := u.Scope.Substitute(field.Src)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	contentType := field.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field.Key, filepath.Base(src)))
+	h.Set("Content-Type", contentType)
+
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// uploadChunked splits field.Src into Runner.ChunkSize pieces and sends
+// each one with method (Content-Range identifies its place in the whole
+// file) over Runner.UploadWorkers concurrent requests. The highest
+// acknowledged offset is kept per (url, file) pair so a VU that errors out
+// mid-file resumes from there instead of re-uploading chunks the server
+// already has - it does not guarantee gapless delivery under concurrency
+// since chunks can complete out of order, but on a retry only chunks
+// entirely below the high-water mark are skipped. The offset is dropped
+// once every chunk has been acknowledged, so the next upload of the same
+// file starts from the beginning.
+func (u *VU) uploadChunked(ctx context.Context, method, reqURL string, headers map[string]string, field FormField, a Auth) error {
+	src := u.Scope.Substitute(field.Src)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	total := info.Size()
+
+	chunkSize := u.Runner.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	workers := u.Runner.UploadWorkers
+	if workers <= 0 {
+		workers = DefaultUploadWorkers
+	}
+
+	key := reqURL + "|" + src
+	u.chunkMu.Lock()
+	resumeFrom := u.chunkOffsets[key]
+	u.chunkMu.Unlock()
+
+	type chunk struct{ start, end int64 }
+	var chunks []chunk
+	for start := int64(0); start < total; start += chunkSize {
+		end := start + chunkSize
+		if end > total {
+			end = total
+		}
+		if end <= resumeFrom {
+			continue
+		}
+		chunks = append(chunks, chunk{start, end})
+	}
+
+	jobs := make(chan chunk)
+	errs := make(chan error, workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	for n := 0; n < workers; n++ {
+		go func() {
+			for c := range jobs {
+				if err := u.uploadChunk(ctx, method, reqURL, headers, f, c.start, c.end, total, a); err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					continue
+				}
+				u.chunkMu.Lock()
+				if c.end > u.chunkOffsets[key] {
+					u.chunkOffsets[key] = c.end
+				}
+				u.chunkMu.Unlock()
+			}
+			done <- struct{}{}
+		}()
+	}
+
+feed:
+	for _, c := range chunks {
+		select {
+		case jobs <- c:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	for n := 0; n < workers; n++ {
+		<-done
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		u.chunkMu.Lock()
+		delete(u.chunkOffsets, key)
+		u.chunkMu.Unlock()
+		return nil
+	}
+}
+
+func (u *VU) uploadChunk(ctx context.Context, method, reqURL string, headers map[string]string, f *os.File, start, end, total int64, a Auth) error {
+	buf := make([]byte, end-start)
+	if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+		return err
+	}
+
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, total))
+	if err := u.applyAuth(req, a, buf); err != nil {
+		return err
+	}
+
+	client := u.clientFor(a)
+	startTime := time.Now()
+	res, err := client.Do(req)
+	duration := time.Since(startTime)
+
+	status := 0
+	if err == nil {
+		status = res.StatusCode
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	tags := stats.Tags{"method": method, "url": reqURL, "status": status}
+	u.Collector.Add(stats.Sample{
+		Stat:   &mChunks,
+		Tags:   tags,
+		Values: stats.Values{"duration": float64(duration), "bytes": float64(len(buf))},
+	})
+
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return fmt.Errorf("chunk upload to %s failed with status %d", reqURL, status)
+	}
+	return nil
+}
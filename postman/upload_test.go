@@ -0,0 +1,250 @@
+package postman
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func readMultipart(t *testing.T, r io.Reader, contentType string) map[string]string {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("ParseMediaType(%q): %v", contentType, err)
+	}
+	mr := multipart.NewReader(r, params["boundary"])
+	parts := map[string]string{}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatalf("reading part %q: %v", p.FormName(), err)
+		}
+		parts[p.FormName()] = string(b)
+	}
+	return parts
+}
+
+func TestBuildFormDataStreamsFieldsAndFiles(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "k6-upload-test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString("file-contents"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	tmp.Close()
+
+	u := newFullTestVU()
+	body := Body{
+		Mode: "formdata",
+		FormData: []FormField{
+			{Key: "name", Value: "alice", Enabled: true},
+			{Key: "upload", Type: "file", Src: tmp.Name(), Enabled: true},
+		},
+	}
+
+	pr, contentType, err := u.buildFormData(body)
+	if err != nil {
+		t.Fatalf("buildFormData: %v", err)
+	}
+	parts := readMultipart(t, pr, contentType)
+
+	if parts["name"] != "alice" {
+		t.Errorf("field name = %q, want alice", parts["name"])
+	}
+	if parts["upload"] != "file-contents" {
+		t.Errorf("field upload = %q, want file-contents", parts["upload"])
+	}
+}
+
+func TestBuildFormDataBufferMatchesStreamedContent(t *testing.T) {
+	u := newFullTestVU()
+	body := Body{
+		Mode: "formdata",
+		FormData: []FormField{
+			{Key: "a", Value: "1", Enabled: true},
+			{Key: "b", Value: "2", Enabled: true},
+			{Key: "disabled", Value: "skip-me", Enabled: false},
+		},
+	}
+
+	buf, contentType, err := u.buildFormDataBuffer(body)
+	if err != nil {
+		t.Fatalf("buildFormDataBuffer: %v", err)
+	}
+	parts := readMultipart(t, bytes.NewReader(buf), contentType)
+
+	if parts["a"] != "1" || parts["b"] != "2" {
+		t.Fatalf("parts = %+v, want a=1 b=2", parts)
+	}
+	if _, ok := parts["disabled"]; ok {
+		t.Fatal("disabled field should have been skipped")
+	}
+
+	pr, streamedType, err := u.buildFormData(body)
+	if err != nil {
+		t.Fatalf("buildFormData: %v", err)
+	}
+	streamed := readMultipart(t, pr, streamedType)
+	if len(streamed) != len(parts) {
+		t.Fatalf("streamed parts = %+v, buffered parts = %+v", streamed, parts)
+	}
+	for k, v := range parts {
+		if streamed[k] != v {
+			t.Fatalf("streamed part %q = %q, buffered = %q", k, streamed[k], v)
+		}
+	}
+}
+
+// TestUploadChunkedReassemblesFile drives a full chunked upload against a
+// server that stitches Content-Range-addressed chunks back together, and
+// checks the reassembled bytes match the source file exactly.
+func TestUploadChunkedReassemblesFile(t *testing.T) {
+	const totalSize = 250 * 1024 // several chunks at a small ChunkSize
+	content := make([]byte, totalSize)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	tmp, err := ioutil.TempFile("", "k6-chunked-upload")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tmp.Close()
+
+	received := make([]byte, totalSize)
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Content-Range")
+		// "bytes start-end/total"
+		var start, end, total int
+		if _, err := parseContentRange(rng, &start, &end, &total); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		copy(received[start:end+1], body)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u := newFullTestVU()
+	u.Runner.ChunkSize = 32 * 1024
+	u.Runner.UploadWorkers = 4
+
+	field := FormField{Key: "file", Type: "file", Src: tmp.Name()}
+	err = u.uploadChunked(context.Background(), "PUT", srv.URL, map[string]string{}, field, Auth{})
+	if err != nil {
+		t.Fatalf("uploadChunked: %v", err)
+	}
+
+	if !bytes.Equal(received, content) {
+		t.Fatal("reassembled upload does not match the source file")
+	}
+}
+
+// TestUploadChunkedResumesFromHighWaterMark seeds chunkOffsets as if a
+// previous attempt had already landed the first chunk, and checks a retry
+// does not re-upload bytes below that offset.
+func TestUploadChunkedResumesFromHighWaterMark(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 100)
+	tmp, err := ioutil.TempFile("", "k6-resume-upload")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tmp.Close()
+
+	var mu sync.Mutex
+	var gotStarts []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end, total int
+		if _, err := parseContentRange(r.Header.Get("Content-Range"), &start, &end, &total); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		gotStarts = append(gotStarts, start)
+		mu.Unlock()
+		io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	u := newFullTestVU()
+	u.Runner.ChunkSize = 40
+	u.Runner.UploadWorkers = 1
+
+	reqURL := srv.URL
+	key := reqURL + "|" + tmp.Name()
+	u.chunkOffsets[key] = 40 // pretend the first chunk already landed
+
+	field := FormField{Key: "file", Type: "file", Src: tmp.Name()}
+	if err := u.uploadChunked(context.Background(), "PUT", reqURL, map[string]string{}, field, Auth{}); err != nil {
+		t.Fatalf("uploadChunked: %v", err)
+	}
+
+	for _, start := range gotStarts {
+		if start < 40 {
+			t.Fatalf("chunk starting at %d was re-uploaded, want only chunks >= the 40-byte high-water mark", start)
+		}
+	}
+	if len(gotStarts) == 0 {
+		t.Fatal("expected at least one chunk to be uploaded")
+	}
+}
+
+// parseContentRange parses a "bytes start-end/total" header into ints.
+func parseContentRange(header string, start, end, total *int) (int, error) {
+	header = strings.TrimPrefix(header, "bytes ")
+	parts := strings.FieldsFunc(header, func(r rune) bool { return r == '-' || r == '/' })
+	if len(parts) != 3 {
+		return 0, errInvalidContentRange
+	}
+	var err error
+	if *start, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, err
+	}
+	if *end, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, err
+	}
+	if *total, err = strconv.Atoi(parts[2]); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+var errInvalidContentRange = errors.New("invalid Content-Range header")